@@ -0,0 +1,108 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// PublishContextDeviceKey is the publish context key under which attach()
+// returns the path of the device node (or equivalent, such as an NVMe
+// subnqn) that NodeStageVolume must stage. Every backend implementation
+// must populate it so that NodeStageVolume can find the device without
+// having to know which backend produced it.
+const PublishContextDeviceKey = "device"
+
+// backend abstracts the actual storage backend (for example Malloc or Ceph
+// RBD bdevs) that provisions and manages volumes on top of SPDK. All of the
+// CSI plumbing in this package talks to the backend through this interface
+// so that it stays independent of the concrete bdev type.
+type backend interface {
+	// createVolume provisions a new volume with the given name (which also
+	// serves as its volume ID) and returns the actual size in bytes, which
+	// may be larger than requiredBytes depending on backend granularity.
+	// isBlock selects whether the volume is meant to be consumed as a raw
+	// block device, in which case no filesystem must be created on it.
+	// params comes from CreateVolumeRequest.Parameters (for example pool,
+	// image-features or mkfs arguments) and secrets from
+	// CreateVolumeRequest.Secrets (for example an encryption passphrase);
+	// both are backend-specific and opaque to this package. The returned
+	// volumeContext is stored verbatim in CreateVolumeResponse.Volume and
+	// handed back to the backend by NodeStageVolume and
+	// ValidateVolumeCapabilities.
+	createVolume(ctx context.Context, name string, requiredBytes int64, isBlock bool, params, secrets map[string]string) (actualBytes int64, volumeContext map[string]string, err error)
+
+	// deleteVolume removes the volume. It must not fail when the volume
+	// does not exist (idempotent delete).
+	deleteVolume(ctx context.Context, name string) error
+
+	// checkVolumeExists returns an error (gRPC NotFound) when the volume
+	// does not exist.
+	checkVolumeExists(ctx context.Context, name string) error
+
+	// validateVolumeContext returns an error when volumeContext does not
+	// match what the backend has on record for the volume (which implies
+	// checking that the volume exists in the first place).
+	validateVolumeContext(ctx context.Context, name string, volumeContext map[string]string) error
+
+	// createSnapshot creates a new snapshot of sourceVolumeID and returns
+	// it. It must be idempotent: calling it again with the same name and
+	// sourceVolumeID must return the existing snapshot instead of failing.
+	createSnapshot(ctx context.Context, sourceVolumeID, name string) (snapshot csi.Snapshot, err error)
+
+	// deleteSnapshot removes the snapshot. It must not fail when the
+	// snapshot does not exist (idempotent delete).
+	deleteSnapshot(ctx context.Context, snapshotID string) error
+
+	// listSnapshots returns up to maxEntries snapshots starting after
+	// startingToken, optionally filtered by sourceVolumeID and/or
+	// snapshotID. It returns the opaque token to resume listing after the
+	// returned snapshots, or "" when there are no more.
+	listSnapshots(ctx context.Context, maxEntries int32, startingToken, sourceVolumeID, snapshotID string) (snapshots []csi.Snapshot, nextToken string, err error)
+
+	// cloneVolumeFromSnapshot provisions a new volume with the given name,
+	// initialized from the content of snapshotID. isBlock, params and
+	// secrets have the same meaning as in createVolume.
+	cloneVolumeFromSnapshot(ctx context.Context, name, snapshotID string, requiredBytes int64, isBlock bool, params, secrets map[string]string) (actualBytes int64, volumeContext map[string]string, err error)
+
+	// attach makes the volume accessible on the given node and returns the
+	// publish context, which must include PublishContextDeviceKey set to
+	// the backing device (for example its PCI BDF or NVMe subnqn) that
+	// NodeStageVolume needs to find it. It must be idempotent: attaching an
+	// already-attached (volumeID, nodeID) pair returns the existing publish
+	// context instead of failing. secrets comes from
+	// ControllerPublishVolumeRequest.Secrets.
+	attach(ctx context.Context, volumeID, nodeID string, secrets map[string]string) (publishContext map[string]string, err error)
+
+	// detach undoes attach. It must not fail when the volume is not
+	// attached to the node (idempotent detach).
+	detach(ctx context.Context, volumeID, nodeID string) error
+
+	// maxAttachments returns how many volumes a single node may have
+	// attached at once, for reporting via NodeGetInfo. Zero means
+	// unlimited.
+	maxAttachments() int64
+
+	// getCapacity queries the underlying bdev pool (for example an LVM/LVS
+	// free_clusters * cluster_size computation, or the free RAM budget for
+	// Malloc) and returns the currently available capacity in bytes and the
+	// largest single volume that can be created right now, optionally
+	// restricted to params and topology.
+	getCapacity(ctx context.Context, params map[string]string, topology *csi.Topology) (availableBytes, maxVolumeSizeBytes int64, err error)
+
+	// listVolumes enumerates bdevs, returning up to maxEntries volumes
+	// starting after startingToken. It returns the opaque token to resume
+	// listing after the returned volumes, or "" when there are no more.
+	listVolumes(ctx context.Context, maxEntries int32, startingToken string) (volumes []csi.Volume, nextToken string, err error)
+
+	// volumeCondition reports the current health of the volume, surfaced in
+	// ListVolumesResponse.Entry.Status because this package advertises the
+	// VOLUME_CONDITION controller capability.
+	volumeCondition(ctx context.Context, volumeID string) (abnormal bool, message string, err error)
+}
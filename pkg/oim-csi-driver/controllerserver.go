@@ -12,10 +12,31 @@ import (
 
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 )
 
+// isMultiWriter classifies a volume capability's access mode, returning
+// whether it allows more than one concurrent writer and whether the
+// capability is for raw block access. The pre-CSI-1.5 SINGLE_NODE_WRITER
+// mode is ambiguous about whether multiple writers are allowed. We only
+// resolve that ambiguity towards "multi" for Block capabilities, where the
+// extra permissiveness is harmless; for Mount capabilities it keeps meaning
+// what it always did, a single writer, so that the common case of a plain
+// ReadWriteOnce filesystem volume keeps working unconditionally.
+func isMultiWriter(cap *csi.VolumeCapability) (multi bool, block bool) {
+	block = cap.GetBlock() != nil
+	switch cap.GetAccessMode().GetMode() {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:
+		multi = true
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER:
+		multi = block
+	}
+	return multi, block
+}
+
 func (od *oimDriver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
 	name := req.GetName()
 	caps := req.GetVolumeCapabilities()
@@ -26,27 +47,45 @@ func (od *oimDriver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequ
 	if caps == nil {
 		return nil, status.Error(codes.InvalidArgument, "Volume Capabilities missing in request")
 	}
+	isBlock := false
 	for _, cap := range caps {
 		if cap.GetBlock() != nil {
-			return nil, status.Error(codes.Unimplemented, "Block Volume not supported")
+			isBlock = true
 		}
 		switch cap.GetAccessMode().GetMode() {
-		case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER: // okay
-		case csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY: // okay
-		case csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY: // okay
-
+		// SINGLE_NODE_SINGLE_WRITER also covers Kubernetes' ReadWriteOncePod:
+		// the CSI spec has no separate access mode for it, RWOP just adds a
+		// CO-side guarantee that at most one pod uses the volume at a time.
+		case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+			csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
+			csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+			csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+			csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:
+			// Concurrent writers can only be safe when the CO (and the application)
+			// take care of coordinating raw block I/O themselves; we cannot
+			// guarantee that for a mounted filesystem.
+			if multi, block := isMultiWriter(cap); multi && !block {
+				return nil, status.Error(codes.Unimplemented, "multi-writer not supported for mounted filesystems")
+			}
 		case csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER:
 			// While in theory writing blocks on one node and reading them on others could work,
 			// in practice caching effects might break that. Better don't allow it.
 			return nil, status.Error(codes.Unimplemented, "multi-node reader, single writer not supported")
-		case csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:
-			return nil, status.Error(codes.Unimplemented, "multi-node reader, multi-node writer not supported")
 		default:
 			return nil, status.Error(codes.Unimplemented, fmt.Sprintf("%s not supported", cap.GetAccessMode().GetMode()))
 		}
 	}
-	if req.GetVolumeContentSource() != nil {
-		return nil, status.Error(codes.Unimplemented, "snapshots not supported")
+	var snapshotID string
+	if source := req.GetVolumeContentSource(); source != nil {
+		snapshot := source.GetSnapshot()
+		if snapshot == nil {
+			return nil, status.Error(codes.Unimplemented, "only snapshots are supported as volume content source")
+		}
+		snapshotID = snapshot.GetSnapshotId()
+		if snapshotID == "" {
+			return nil, status.Error(codes.InvalidArgument, "SnapshotId missing in volume content source")
+		}
 	}
 
 	// Serialize operations per volume by name.
@@ -56,7 +95,14 @@ func (od *oimDriver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequ
 	volumeNameMutex.LockKey(name)
 	defer volumeNameMutex.UnlockKey(name)
 
-	actualBytes, err := od.backend.createVolume(ctx, name, req.GetCapacityRange().GetRequiredBytes())
+	var actualBytes int64
+	var volumeContext map[string]string
+	var err error
+	if snapshotID != "" {
+		actualBytes, volumeContext, err = od.backend.cloneVolumeFromSnapshot(ctx, name, snapshotID, req.GetCapacityRange().GetRequiredBytes(), isBlock, req.GetParameters(), req.GetSecrets())
+	} else {
+		actualBytes, volumeContext, err = od.backend.createVolume(ctx, name, req.GetCapacityRange().GetRequiredBytes(), isBlock, req.GetParameters(), req.GetSecrets())
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -65,6 +111,8 @@ func (od *oimDriver) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequ
 			// We use the unique name also as ID.
 			VolumeId:      name,
 			CapacityBytes: actualBytes,
+			VolumeContext: volumeContext,
+			ContentSource: req.GetVolumeContentSource(),
 		},
 	}, nil
 }
@@ -90,11 +138,51 @@ func (od *oimDriver) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequ
 }
 
 func (od *oimDriver) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	volumeID := req.GetVolumeId()
+	nodeID := req.GetNodeId()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if nodeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "Node ID missing in request")
+	}
+	if req.GetVolumeCapability() == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability missing in request")
+	}
+
+	if err := od.backend.checkVolumeExists(ctx, volumeID); err != nil {
+		return nil, err
+	}
+
+	// Serialize attach/detach per volume.
+	attachMutex.LockKey(volumeID)
+	defer attachMutex.UnlockKey(volumeID)
+
+	publishContext, err := od.backend.attach(ctx, volumeID, nodeID, req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+	return &csi.ControllerPublishVolumeResponse{
+		PublishContext: publishContext,
+	}, nil
 }
 
 func (od *oimDriver) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	volumeID := req.GetVolumeId()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	// NodeId is optional: the CO may leave it empty to ask for detaching
+	// from whatever node the volume is currently attached to.
+	nodeID := req.GetNodeId()
+
+	attachMutex.LockKey(volumeID)
+	defer attachMutex.UnlockKey(volumeID)
+
+	if err := od.backend.detach(ctx, volumeID, nodeID); err != nil {
+		return nil, err
+	}
+	return &csi.ControllerUnpublishVolumeResponse{}, nil
 }
 
 func (od *oimDriver) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
@@ -115,40 +203,38 @@ func (od *oimDriver) ValidateVolumeCapabilities(ctx context.Context, req *csi.Va
 	volumeNameMutex.LockKey(name)
 	defer volumeNameMutex.UnlockKey(name)
 
-	// Check that volume exists.
-	if err := od.backend.checkVolumeExists(ctx, req.GetVolumeId()); err != nil {
+	// Check that the volume exists and that the caller's VolumeContext still
+	// matches what the backend has on record for it, instead of blindly
+	// trusting and echoing back whatever the caller sent.
+	if err := od.backend.validateVolumeContext(ctx, req.GetVolumeId(), req.GetVolumeContext()); err != nil {
 		return nil, err
 	}
 
 	confirmed := &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
-		// We don't actually do any validation of these (don't even use them!).
-		// It's also unclear from the spec what a CO would do with the validated
-		// values, because both are opaque to the CO.
 		VolumeContext: req.VolumeContext,
 		Parameters:    req.Parameters,
 	}
 	for _, cap := range req.VolumeCapabilities {
-		if cap.GetBlock() != nil {
-			/* Known unsupported mode. Fail the validation. */
-			return &csi.ValidateVolumeCapabilitiesResponse{Message: "Block Volume not supported"}, nil
-		}
-		if cap.GetMount() == nil {
+		if cap.GetBlock() == nil && cap.GetMount() == nil {
 			/* Must be something else, an unknown mode. Ignore it. */
 			continue
 		}
 		// We could check fs type and mount flags for MountVolume, but let's assume that they are okay.
 		// Now check the access mode.
 		switch cap.GetAccessMode().GetMode() {
-		case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER: // okay
-		case csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY: // okay
-		case csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY: // okay
-
+		case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+			csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+			csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
+			csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+			csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+			csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:
+			if multi, block := isMultiWriter(cap); multi && !block {
+				return &csi.ValidateVolumeCapabilitiesResponse{Message: "multi-writer not supported for mounted filesystems"}, nil
+			}
 		case csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER:
 			// While in theory writing blocks on one node and reading them on others could work,
 			// in practice caching effects might break that. Better don't allow it.
 			return &csi.ValidateVolumeCapabilitiesResponse{Message: "multi-node reader, single writer not supported"}, nil
-		case csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:
-			return &csi.ValidateVolumeCapabilitiesResponse{Message: "multi-node reader, multi-node writer not supported"}, nil
 		default:
 			/* unknown, not supported */
 			continue
@@ -159,11 +245,42 @@ func (od *oimDriver) ValidateVolumeCapabilities(ctx context.Context, req *csi.Va
 }
 
 func (od *oimDriver) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	volumes, nextToken, err := od.backend.listVolumes(ctx, req.GetMaxEntries(), req.GetStartingToken())
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*csi.ListVolumesResponse_Entry, 0, len(volumes))
+	for i := range volumes {
+		abnormal, message, err := od.backend.volumeCondition(ctx, volumes[i].VolumeId)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, &csi.ListVolumesResponse_Entry{
+			Volume: &volumes[i],
+			Status: &csi.ListVolumesResponse_VolumeStatus{
+				VolumeCondition: &csi.VolumeCondition{
+					Abnormal: abnormal,
+					Message:  message,
+				},
+			},
+		})
+	}
+	return &csi.ListVolumesResponse{
+		Entries:   entries,
+		NextToken: nextToken,
+	}, nil
 }
 
 func (od *oimDriver) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	availableBytes, maxVolumeSizeBytes, err := od.backend.getCapacity(ctx, req.GetParameters(), req.GetAccessibleTopology())
+	if err != nil {
+		return nil, err
+	}
+	return &csi.GetCapacityResponse{
+		AvailableCapacity: availableBytes,
+		MaximumVolumeSize: &wrapperspb.Int64Value{Value: maxVolumeSizeBytes},
+	}, nil
 }
 
 // ControllerGetCapabilities implements the default GRPC callout.
@@ -175,15 +292,61 @@ func (od *oimDriver) ControllerGetCapabilities(ctx context.Context, req *csi.Con
 }
 
 func (od *oimDriver) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	name := req.GetName()
+	sourceVolumeID := req.GetSourceVolumeId()
+
+	if name == "" {
+		return nil, status.Error(codes.InvalidArgument, "Name missing in request")
+	}
+	if sourceVolumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "SourceVolumeId missing in request")
+	}
+
+	// Serialize operations per snapshot by name.
+	snapshotNameMutex.LockKey(name)
+	defer snapshotNameMutex.UnlockKey(name)
+
+	snapshot, err := od.backend.createSnapshot(ctx, sourceVolumeID, name)
+	if err != nil {
+		return nil, err
+	}
+	return &csi.CreateSnapshotResponse{
+		Snapshot: &snapshot,
+	}, nil
 }
 
 func (od *oimDriver) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	snapshotID := req.GetSnapshotId()
+	if snapshotID == "" {
+		return nil, status.Error(codes.InvalidArgument, "SnapshotId missing in request")
+	}
+
+	// The snapshot ID is the same as the snapshot name in CreateSnapshot. Serialize by that.
+	snapshotNameMutex.LockKey(snapshotID)
+	defer snapshotNameMutex.UnlockKey(snapshotID)
+
+	if err := od.backend.deleteSnapshot(ctx, snapshotID); err != nil {
+		return nil, err
+	}
+	return &csi.DeleteSnapshotResponse{}, nil
 }
 
 func (od *oimDriver) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	snapshots, nextToken, err := od.backend.listSnapshots(ctx, req.GetMaxEntries(), req.GetStartingToken(), req.GetSourceVolumeId(), req.GetSnapshotId())
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*csi.ListSnapshotsResponse_Entry, 0, len(snapshots))
+	for i := range snapshots {
+		entries = append(entries, &csi.ListSnapshotsResponse_Entry{
+			Snapshot: &snapshots[i],
+		})
+	}
+	return &csi.ListSnapshotsResponse{
+		Entries:   entries,
+		NextToken: nextToken,
+	}, nil
 }
 
 func (od *oimDriver) ControllerExpandVolume(context.Context, *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
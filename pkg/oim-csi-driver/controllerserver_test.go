@@ -0,0 +1,207 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// fakeBackend is a no-op backend implementation used to exercise the gRPC
+// plumbing in this package without any real SPDK bdevs.
+type fakeBackend struct{}
+
+func (fakeBackend) createVolume(ctx context.Context, name string, requiredBytes int64, isBlock bool, params, secrets map[string]string) (int64, map[string]string, error) {
+	return requiredBytes, nil, nil
+}
+func (fakeBackend) deleteVolume(ctx context.Context, name string) error      { return nil }
+func (fakeBackend) checkVolumeExists(ctx context.Context, name string) error { return nil }
+func (fakeBackend) validateVolumeContext(ctx context.Context, name string, volumeContext map[string]string) error {
+	return nil
+}
+func (fakeBackend) createSnapshot(ctx context.Context, sourceVolumeID, name string) (csi.Snapshot, error) {
+	return csi.Snapshot{SnapshotId: name, SourceVolumeId: sourceVolumeID}, nil
+}
+func (fakeBackend) deleteSnapshot(ctx context.Context, snapshotID string) error { return nil }
+func (fakeBackend) listSnapshots(ctx context.Context, maxEntries int32, startingToken, sourceVolumeID, snapshotID string) ([]csi.Snapshot, string, error) {
+	return nil, "", nil
+}
+func (fakeBackend) cloneVolumeFromSnapshot(ctx context.Context, name, snapshotID string, requiredBytes int64, isBlock bool, params, secrets map[string]string) (int64, map[string]string, error) {
+	return requiredBytes, nil, nil
+}
+func (fakeBackend) attach(ctx context.Context, volumeID, nodeID string, secrets map[string]string) (map[string]string, error) {
+	return nil, nil
+}
+func (fakeBackend) detach(ctx context.Context, volumeID, nodeID string) error { return nil }
+func (fakeBackend) maxAttachments() int64                                     { return 0 }
+func (fakeBackend) getCapacity(ctx context.Context, params map[string]string, topology *csi.Topology) (int64, int64, error) {
+	return 0, 0, nil
+}
+func (fakeBackend) listVolumes(ctx context.Context, maxEntries int32, startingToken string) ([]csi.Volume, string, error) {
+	return nil, "", nil
+}
+func (fakeBackend) volumeCondition(ctx context.Context, volumeID string) (bool, string, error) {
+	return false, "", nil
+}
+
+func newTestDriver() *oimDriver {
+	return NewOimDriver("test-node", fakeBackend{})
+}
+
+// allAccessModes covers every csi.VolumeCapability_AccessMode_Mode that
+// CreateVolume/ValidateVolumeCapabilities have to classify, including the
+// CSI 1.5 additions and the legacy ambiguous SINGLE_NODE_WRITER.
+var allAccessModes = []csi.VolumeCapability_AccessMode_Mode{
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+	csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+	csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER,
+	csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+}
+
+func mountCap(mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+	}
+}
+
+func blockCap(mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+	}
+}
+
+func TestIsMultiWriter(t *testing.T) {
+	for _, mode := range allAccessModes {
+		for _, tc := range []struct {
+			name      string
+			cap       *csi.VolumeCapability
+			wantMulti bool
+			wantBlock bool
+		}{
+			{"mount", mountCap(mode), false, false},
+			{"block", blockCap(mode), false, true},
+		} {
+			tc := tc
+			mode := mode
+			wantMulti := tc.wantMulti
+			switch mode {
+			case csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
+				csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:
+				wantMulti = true
+			case csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER:
+				// Ambiguous: resolved towards "multi" only for Block.
+				wantMulti = tc.wantBlock
+			}
+			t.Run(mode.String()+"/"+tc.name, func(t *testing.T) {
+				multi, block := isMultiWriter(tc.cap)
+				if multi != wantMulti {
+					t.Errorf("isMultiWriter(%s, %s) multi = %v, want %v", mode, tc.name, multi, wantMulti)
+				}
+				if block != tc.wantBlock {
+					t.Errorf("isMultiWriter(%s, %s) block = %v, want %v", mode, tc.name, block, tc.wantBlock)
+				}
+			})
+		}
+	}
+}
+
+// wantReject reports whether CreateVolume/ValidateVolumeCapabilities must
+// reject the given access mode for the given access type.
+func wantReject(mode csi.VolumeCapability_AccessMode_Mode, isBlock bool) bool {
+	switch mode {
+	case csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER:
+		return true
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER:
+		return !isBlock
+	default:
+		return false
+	}
+}
+
+func TestCreateVolumeAccessModeMatrix(t *testing.T) {
+	od := newTestDriver()
+	for _, mode := range allAccessModes {
+		for _, tc := range []struct {
+			name    string
+			cap     *csi.VolumeCapability
+			isBlock bool
+		}{
+			{"mount", mountCap(mode), false},
+			{"block", blockCap(mode), true},
+		} {
+			t.Run(mode.String()+"/"+tc.name, func(t *testing.T) {
+				_, err := od.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+					Name:               "vol-" + mode.String() + "-" + tc.name,
+					VolumeCapabilities: []*csi.VolumeCapability{tc.cap},
+				})
+				reject := wantReject(mode, tc.isBlock)
+				if reject && err == nil {
+					t.Errorf("CreateVolume(%s, %s): expected error, got none", mode, tc.name)
+				}
+				if !reject && err != nil {
+					t.Errorf("CreateVolume(%s, %s): unexpected error: %v", mode, tc.name, err)
+				}
+			})
+		}
+	}
+}
+
+func TestValidateVolumeCapabilitiesAccessModeMatrix(t *testing.T) {
+	od := newTestDriver()
+	for _, mode := range allAccessModes {
+		for _, tc := range []struct {
+			name    string
+			cap     *csi.VolumeCapability
+			isBlock bool
+		}{
+			{"mount", mountCap(mode), false},
+			{"block", blockCap(mode), true},
+		} {
+			t.Run(mode.String()+"/"+tc.name, func(t *testing.T) {
+				resp, err := od.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+					VolumeId:           "vol",
+					VolumeCapabilities: []*csi.VolumeCapability{tc.cap},
+				})
+				if err != nil {
+					t.Fatalf("ValidateVolumeCapabilities(%s, %s): unexpected error: %v", mode, tc.name, err)
+				}
+				reject := wantReject(mode, tc.isBlock)
+				confirmed := resp.GetConfirmed() != nil && len(resp.GetConfirmed().GetVolumeCapabilities()) == 1
+				if reject && confirmed {
+					t.Errorf("ValidateVolumeCapabilities(%s, %s): expected capability to be rejected, but it was confirmed", mode, tc.name)
+				}
+				if !reject && !confirmed {
+					t.Errorf("ValidateVolumeCapabilities(%s, %s): expected capability to be confirmed, but it was not: %+v", mode, tc.name, resp)
+				}
+			})
+		}
+	}
+}
+
+func TestCreateVolumeSingleNodeWriterMountAccepted(t *testing.T) {
+	// Regression test: a plain ReadWriteOnce (SINGLE_NODE_WRITER) mounted
+	// filesystem volume, the single most common CSI request shape, must
+	// keep being accepted unconditionally.
+	od := newTestDriver()
+	_, err := od.CreateVolume(context.Background(), &csi.CreateVolumeRequest{
+		Name: "rwo-vol",
+		VolumeCapabilities: []*csi.VolumeCapability{
+			mountCap(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER),
+		},
+	})
+	if err != nil {
+		t.Fatalf("CreateVolume with SINGLE_NODE_WRITER mount capability: unexpected error: %v", err)
+	}
+}
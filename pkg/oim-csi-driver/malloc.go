@@ -0,0 +1,417 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// mallocBackend is a backend implementation on top of SPDK's Malloc bdevs,
+// which are backed by plain RAM instead of persistent storage. It keeps all
+// state in memory and carves volumes out of a fixed RAM budget, which makes
+// it useful for testing oimcsidriver and for small deployments that don't
+// need volumes to survive a restart.
+type mallocBackend struct {
+	mu          sync.Mutex
+	budgetBytes int64
+	usedBytes   int64
+	volumes     map[string]*mallocVolume
+	snapshots   map[string]*mallocSnapshot
+	// attachments maps a nodeID to the set of volumeIDs currently attached
+	// to it, so attach/detach can both find existing attachments and
+	// enforce maxVolumesPerNode.
+	attachments map[string]map[string]bool
+	// maxVolumesPerNode bounds how many volumes a single node may have
+	// attached at once, surfaced via NodeGetInfo. Zero means unlimited.
+	maxVolumesPerNode int64
+}
+
+type mallocVolume struct {
+	sizeBytes int64
+	// isBlock records whether the volume was created for raw block
+	// consumption. A Malloc bdev itself is already just bytes either way.
+	// Nothing in this backend reads the field: NodeStageVolume decides
+	// whether to skip mkfs from the volume capability it is given, and
+	// volumeCondition does not report it.
+	isBlock       bool
+	volumeContext map[string]string
+}
+
+type mallocSnapshot struct {
+	sourceVolumeID string
+	sizeBytes      int64
+	creationTime   time.Time
+}
+
+// NewMallocBackend creates a backend that carves volumes out of a RAM budget
+// of budgetBytes, in units of the SPDK Malloc bdev (no persistence across
+// restarts), and allows at most maxVolumesPerNode attachments per node (zero
+// for unlimited).
+func NewMallocBackend(budgetBytes, maxVolumesPerNode int64) *mallocBackend {
+	return &mallocBackend{
+		budgetBytes:       budgetBytes,
+		volumes:           make(map[string]*mallocVolume),
+		snapshots:         make(map[string]*mallocSnapshot),
+		attachments:       make(map[string]map[string]bool),
+		maxVolumesPerNode: maxVolumesPerNode,
+	}
+}
+
+// createVolume accepts secrets for interface compatibility with backends
+// that need to authenticate against a remote cluster (Ceph RBD's cephx
+// keys, for example), but a Malloc bdev is local RAM with nothing to
+// authenticate against, so secrets are otherwise unused here. params is
+// stored verbatim into volumeContext so it comes back unchanged through
+// CreateVolumeResponse.Volume and later ValidateVolumeCapabilities calls.
+func (b *mallocBackend) createVolume(ctx context.Context, name string, requiredBytes int64, isBlock bool, params, secrets map[string]string) (int64, map[string]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if v, ok := b.volumes[name]; ok {
+		if v.sizeBytes < requiredBytes {
+			return 0, nil, status.Errorf(codes.AlreadyExists, "volume %q already exists with a smaller size", name)
+		}
+		return v.sizeBytes, v.volumeContext, nil
+	}
+
+	if b.usedBytes+requiredBytes > b.budgetBytes {
+		return 0, nil, status.Errorf(codes.ResourceExhausted, "not enough RAM budget left for a %d byte Malloc volume", requiredBytes)
+	}
+
+	volumeContext := make(map[string]string, len(params))
+	for k, v := range params {
+		volumeContext[k] = v
+	}
+	b.volumes[name] = &mallocVolume{
+		sizeBytes:     requiredBytes,
+		isBlock:       isBlock,
+		volumeContext: volumeContext,
+	}
+	b.usedBytes += requiredBytes
+	return requiredBytes, volumeContext, nil
+}
+
+func (b *mallocBackend) deleteVolume(ctx context.Context, name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	v, ok := b.volumes[name]
+	if !ok {
+		return nil
+	}
+	b.usedBytes -= v.sizeBytes
+	delete(b.volumes, name)
+	return nil
+}
+
+func (b *mallocBackend) checkVolumeExists(ctx context.Context, name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.volumes[name]; !ok {
+		return status.Errorf(codes.NotFound, "volume %q does not exist", name)
+	}
+	return nil
+}
+
+func (b *mallocBackend) validateVolumeContext(ctx context.Context, name string, volumeContext map[string]string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	v, ok := b.volumes[name]
+	if !ok {
+		return status.Errorf(codes.NotFound, "volume %q does not exist", name)
+	}
+	for k, want := range volumeContext {
+		if got := v.volumeContext[k]; got != want {
+			return status.Errorf(codes.InvalidArgument, "volume %q: volume_context[%q] = %q, want %q", name, k, want, got)
+		}
+	}
+	return nil
+}
+
+// device returns the device node that a Malloc bdev for name is exposed as.
+// Real deployments would get this from the SPDK JSON-RPC bdev_malloc_create
+// response; there is only one way to name a RAM disk here, so it is derived
+// from the volume name.
+func (b *mallocBackend) device(name string) string {
+	return fmt.Sprintf("/dev/malloc/%s", name)
+}
+
+func (b *mallocBackend) createSnapshot(ctx context.Context, sourceVolumeID, name string) (csi.Snapshot, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if s, ok := b.snapshots[name]; ok {
+		if s.sourceVolumeID != sourceVolumeID {
+			return csi.Snapshot{}, status.Errorf(codes.AlreadyExists, "snapshot %q already exists for a different source volume", name)
+		}
+		return b.snapshotProto(name, s), nil
+	}
+
+	v, ok := b.volumes[sourceVolumeID]
+	if !ok {
+		return csi.Snapshot{}, status.Errorf(codes.NotFound, "source volume %q does not exist", sourceVolumeID)
+	}
+	if b.usedBytes+v.sizeBytes > b.budgetBytes {
+		return csi.Snapshot{}, status.Errorf(codes.ResourceExhausted, "not enough RAM budget left to snapshot volume %q", sourceVolumeID)
+	}
+
+	s := &mallocSnapshot{
+		sourceVolumeID: sourceVolumeID,
+		sizeBytes:      v.sizeBytes,
+		creationTime:   time.Now(),
+	}
+	b.snapshots[name] = s
+	b.usedBytes += s.sizeBytes
+	return b.snapshotProto(name, s), nil
+}
+
+func (b *mallocBackend) snapshotProto(id string, s *mallocSnapshot) csi.Snapshot {
+	return csi.Snapshot{
+		SnapshotId:     id,
+		SourceVolumeId: s.sourceVolumeID,
+		SizeBytes:      s.sizeBytes,
+		CreationTime:   timestamppb.New(s.creationTime),
+		ReadyToUse:     true,
+	}
+}
+
+func (b *mallocBackend) deleteSnapshot(ctx context.Context, snapshotID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s, ok := b.snapshots[snapshotID]
+	if !ok {
+		return nil
+	}
+	b.usedBytes -= s.sizeBytes
+	delete(b.snapshots, snapshotID)
+	return nil
+}
+
+func (b *mallocBackend) listSnapshots(ctx context.Context, maxEntries int32, startingToken, sourceVolumeID, snapshotID string) ([]csi.Snapshot, string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	offset, err := decodeToken(startingToken)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var ids []string
+	for id, s := range b.snapshots {
+		if snapshotID != "" && id != snapshotID {
+			continue
+		}
+		if sourceVolumeID != "" && s.sourceVolumeID != sourceVolumeID {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	total := len(ids)
+
+	if offset > len(ids) {
+		return nil, "", status.Error(codes.Aborted, "starting_token is out of range")
+	}
+	ids = ids[offset:]
+	if maxEntries > 0 && int32(len(ids)) > maxEntries {
+		ids = ids[:maxEntries]
+	}
+
+	snapshots := make([]csi.Snapshot, 0, len(ids))
+	for _, id := range ids {
+		snapshots = append(snapshots, b.snapshotProto(id, b.snapshots[id]))
+	}
+
+	nextToken := ""
+	if next := offset + len(ids); next < total {
+		nextToken = encodeToken(next)
+	}
+	return snapshots, nextToken, nil
+}
+
+func (b *mallocBackend) cloneVolumeFromSnapshot(ctx context.Context, name, snapshotID string, requiredBytes int64, isBlock bool, params, secrets map[string]string) (int64, map[string]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if v, ok := b.volumes[name]; ok {
+		return v.sizeBytes, v.volumeContext, nil
+	}
+
+	s, ok := b.snapshots[snapshotID]
+	if !ok {
+		return 0, nil, status.Errorf(codes.NotFound, "snapshot %q does not exist", snapshotID)
+	}
+	sizeBytes := s.sizeBytes
+	if requiredBytes > sizeBytes {
+		sizeBytes = requiredBytes
+	}
+	if b.usedBytes+sizeBytes > b.budgetBytes {
+		return 0, nil, status.Errorf(codes.ResourceExhausted, "not enough RAM budget left for a %d byte clone of snapshot %q", sizeBytes, snapshotID)
+	}
+
+	volumeContext := make(map[string]string, len(params))
+	for k, v := range params {
+		volumeContext[k] = v
+	}
+	b.volumes[name] = &mallocVolume{
+		sizeBytes:     sizeBytes,
+		isBlock:       isBlock,
+		volumeContext: volumeContext,
+	}
+	b.usedBytes += sizeBytes
+	return sizeBytes, volumeContext, nil
+}
+
+// encodeToken and decodeToken implement the opaque pagination tokens handed
+// out by listSnapshots/listVolumes: a base64-encoded decimal offset into the
+// sorted id list, so that callers can't rely on it being anything else.
+func encodeToken(offset int) string {
+	if offset <= 0 {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString([]byte(strconv.Itoa(offset)))
+}
+
+func decodeToken(token string) (int, error) {
+	if token == "" {
+		return 0, nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return 0, status.Error(codes.Aborted, "invalid starting_token")
+	}
+	offset, err := strconv.Atoi(string(raw))
+	if err != nil || offset < 0 {
+		return 0, status.Error(codes.Aborted, "invalid starting_token")
+	}
+	return offset, nil
+}
+
+func (b *mallocBackend) attach(ctx context.Context, volumeID, nodeID string, secrets map[string]string) (map[string]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.volumes[volumeID]; !ok {
+		return nil, status.Errorf(codes.NotFound, "volume %q does not exist", volumeID)
+	}
+
+	publishContext := map[string]string{PublishContextDeviceKey: b.device(volumeID)}
+	if attached, ok := b.attachments[nodeID]; ok && attached[volumeID] {
+		return publishContext, nil
+	}
+
+	if b.maxVolumesPerNode > 0 && int64(len(b.attachments[nodeID])) >= b.maxVolumesPerNode {
+		return nil, status.Errorf(codes.ResourceExhausted, "node %q already has the maximum of %d volumes attached", nodeID, b.maxVolumesPerNode)
+	}
+
+	if b.attachments[nodeID] == nil {
+		b.attachments[nodeID] = make(map[string]bool)
+	}
+	b.attachments[nodeID][volumeID] = true
+	return publishContext, nil
+}
+
+func (b *mallocBackend) detach(ctx context.Context, volumeID, nodeID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if nodeID == "" {
+		for _, attached := range b.attachments {
+			delete(attached, volumeID)
+		}
+		return nil
+	}
+	delete(b.attachments[nodeID], volumeID)
+	return nil
+}
+
+func (b *mallocBackend) maxAttachments() int64 {
+	return b.maxVolumesPerNode
+}
+
+// getCapacity ignores params and topology: a Malloc bdev has no pools or
+// topology to restrict against, just the single RAM budget.
+func (b *mallocBackend) getCapacity(ctx context.Context, params map[string]string, topology *csi.Topology) (int64, int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	available := b.budgetBytes - b.usedBytes
+	// A single new volume could claim all of what's left.
+	return available, available, nil
+}
+
+func (b *mallocBackend) listVolumes(ctx context.Context, maxEntries int32, startingToken string) ([]csi.Volume, string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	offset, err := decodeToken(startingToken)
+	if err != nil {
+		return nil, "", err
+	}
+
+	ids := make([]string, 0, len(b.volumes))
+	for id := range b.volumes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	if offset > len(ids) {
+		return nil, "", status.Error(codes.Aborted, "starting_token is out of range")
+	}
+	ids = ids[offset:]
+	if maxEntries > 0 && int32(len(ids)) > maxEntries {
+		ids = ids[:maxEntries]
+	}
+
+	volumes := make([]csi.Volume, 0, len(ids))
+	for _, id := range ids {
+		v := b.volumes[id]
+		volumes = append(volumes, csi.Volume{
+			VolumeId:      id,
+			CapacityBytes: v.sizeBytes,
+			VolumeContext: v.volumeContext,
+		})
+	}
+
+	nextToken := ""
+	if next := offset + len(ids); next < len(b.volumes) {
+		nextToken = encodeToken(next)
+	}
+	return volumes, nextToken, nil
+}
+
+// volumeCondition always reports healthy: a Malloc volume that exists is, by
+// construction, backed by live process RAM, so there is no degraded state
+// short of the volume disappearing outright.
+func (b *mallocBackend) volumeCondition(ctx context.Context, volumeID string) (bool, string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.volumes[volumeID]; !ok {
+		return false, "", status.Errorf(codes.NotFound, "volume %q does not exist", volumeID)
+	}
+	return false, "volume is healthy", nil
+}
+
+// var _ backend ensures mallocBackend keeps satisfying the full backend
+// interface as it evolves.
+var _ backend = &mallocBackend{}
@@ -0,0 +1,202 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"context"
+	"os"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	mount "k8s.io/mount-utils"
+	utilexec "k8s.io/utils/exec"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// nodeMounter does the actual formatting/mounting and bind-mounting on the node.
+var nodeMounter = &mount.SafeFormatAndMount{
+	Interface: mount.New(""),
+	Exec:      utilexec.New(),
+}
+
+func (od *oimDriver) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	stagingTargetPath := req.GetStagingTargetPath()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if stagingTargetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path missing in request")
+	}
+	cap := req.GetVolumeCapability()
+	if cap == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability missing in request")
+	}
+
+	device, ok := req.GetPublishContext()[PublishContextDeviceKey]
+	if !ok || device == "" {
+		return nil, status.Error(codes.InvalidArgument, "device missing in publish context")
+	}
+	// req.GetSecrets() is accepted here too (so that a CO never has to
+	// persist credentials in a StorageClass) but isn't needed by the
+	// backends we currently support: attach() already consulted
+	// ControllerPublishVolumeRequest.Secrets to make the device accessible.
+
+	volumeNameMutex.LockKey(volumeID)
+	defer volumeNameMutex.UnlockKey(volumeID)
+
+	if cap.GetBlock() != nil {
+		// Block volumes are staged by bind-mounting the device node onto a
+		// regular file so that NodePublishVolume can bind-mount it again
+		// into the container, without ever creating a filesystem on it.
+		if err := makeFile(stagingTargetPath); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to create staging target file %q: %v", stagingTargetPath, err)
+		}
+		if err := nodeMounter.Mount(device, stagingTargetPath, "", []string{"bind"}); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to bind-mount device %q to %q: %v", device, stagingTargetPath, err)
+		}
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	mnt := cap.GetMount()
+	fsType := mnt.GetFsType()
+	if fsType == "" {
+		fsType = "ext4"
+	}
+	if err := os.MkdirAll(stagingTargetPath, 0750); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create staging target directory %q: %v", stagingTargetPath, err)
+	}
+	if err := nodeMounter.FormatAndMount(device, stagingTargetPath, fsType, mnt.GetMountFlags()); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to format and mount device %q at %q: %v", device, stagingTargetPath, err)
+	}
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+func (od *oimDriver) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	stagingTargetPath := req.GetStagingTargetPath()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if stagingTargetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path missing in request")
+	}
+
+	volumeNameMutex.LockKey(volumeID)
+	defer volumeNameMutex.UnlockKey(volumeID)
+
+	if err := mount.CleanupMountPoint(stagingTargetPath, nodeMounter, false); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to unmount staging target path %q: %v", stagingTargetPath, err)
+	}
+	return &csi.NodeUnstageVolumeResponse{}, nil
+}
+
+func (od *oimDriver) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	stagingTargetPath := req.GetStagingTargetPath()
+	targetPath := req.GetTargetPath()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if stagingTargetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "Staging target path missing in request")
+	}
+	if targetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
+	}
+	cap := req.GetVolumeCapability()
+	if cap == nil {
+		return nil, status.Error(codes.InvalidArgument, "Volume capability missing in request")
+	}
+
+	options := []string{"bind"}
+	if req.GetReadonly() {
+		options = append(options, "ro")
+	}
+
+	if cap.GetBlock() != nil {
+		if err := makeFile(targetPath); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to create target file %q: %v", targetPath, err)
+		}
+	} else if err := os.MkdirAll(targetPath, 0750); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create target directory %q: %v", targetPath, err)
+	}
+
+	if err := nodeMounter.Mount(stagingTargetPath, targetPath, "", options); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to bind-mount %q to %q: %v", stagingTargetPath, targetPath, err)
+	}
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+func (od *oimDriver) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+	targetPath := req.GetTargetPath()
+	if targetPath == "" {
+		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
+	}
+
+	if err := mount.CleanupMountPoint(targetPath, nodeMounter, false); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to unmount target path %q: %v", targetPath, err)
+	}
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
+
+// makeFile creates an empty regular file at path if it does not exist yet,
+// which is what bind-mounting a block device onto requires.
+func makeFile(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE, 0660)
+	if err != nil {
+		if os.IsExist(err) {
+			return nil
+		}
+		return err
+	}
+	return f.Close()
+}
+
+func (od *oimDriver) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+func (od *oimDriver) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
+
+// nodeCapabilities lists the RPCs which oimDriver's node service currently
+// supports. STAGE_UNSTAGE_VOLUME must be advertised for NodeStageVolume and
+// NodeUnstageVolume to ever be called: without it, a compliant CO calls
+// NodePublishVolume directly against the original volume, and the
+// mkfs/mount (or bind-mount, for Block) logic above never runs.
+var nodeCapabilities = []csi.NodeServiceCapability_RPC_Type{
+	csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+}
+
+// NodeGetCapabilities implements the default GRPC callout.
+func (od *oimDriver) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+	var caps []*csi.NodeServiceCapability
+	for _, c := range nodeCapabilities {
+		caps = append(caps, &csi.NodeServiceCapability{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: c,
+				},
+			},
+		})
+	}
+	return &csi.NodeGetCapabilitiesResponse{Capabilities: caps}, nil
+}
+
+// NodeGetInfo returns the node ID that ControllerPublishVolume callers need
+// to pass back to us, together with how many volumes may be
+// attached to it at once.
+func (od *oimDriver) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	return &csi.NodeGetInfoResponse{
+		NodeId:            od.nodeID,
+		MaxVolumesPerNode: od.backend.maxAttachments(),
+	}, nil
+}
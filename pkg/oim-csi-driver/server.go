@@ -0,0 +1,74 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package oimcsidriver
+
+import (
+	"k8s.io/utils/keymutex"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// oimDriver implements the CSI controller and node services on top of a
+// backend which does the actual volume management.
+type oimDriver struct {
+	nodeID  string
+	backend backend
+	cap     []*csi.ControllerServiceCapability
+}
+
+// volumeNameMutex serializes operations for a particular volume, keyed by
+// its name (which is also used as the volume ID).
+var volumeNameMutex = keymutex.NewHashed(0)
+
+// snapshotNameMutex serializes operations for a particular snapshot, keyed
+// by its name (which is also used as the snapshot ID).
+var snapshotNameMutex = keymutex.NewHashed(0)
+
+// attachMutex serializes ControllerPublishVolume/ControllerUnpublishVolume
+// for a particular volume, keyed by volumeID. ControllerUnpublishVolume may
+// be called without a NodeId to mean "detach from whatever node the volume
+// is currently attached to", so the lock has to cover the whole volume
+// rather than a single (volumeID, nodeID) pair: otherwise that call and a
+// concurrent ControllerPublishVolume for a specific node would take
+// different keys and fail to exclude each other.
+var attachMutex = keymutex.NewHashed(0)
+
+// controllerCapabilities lists the RPCs which oimDriver currently supports.
+var controllerCapabilities = []csi.ControllerServiceCapability_RPC_Type{
+	csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+	csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+	csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+	csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+	csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+	csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+	csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
+	csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+}
+
+func newControllerCapabilities() []*csi.ControllerServiceCapability {
+	var caps []*csi.ControllerServiceCapability
+	for _, c := range controllerCapabilities {
+		caps = append(caps, &csi.ControllerServiceCapability{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					Type: c,
+				},
+			},
+		})
+	}
+	return caps
+}
+
+// NewOimDriver creates a driver instance for the node identified by nodeID,
+// backed by the given backend.
+func NewOimDriver(nodeID string, backend backend) *oimDriver {
+	return &oimDriver{
+		nodeID:  nodeID,
+		backend: backend,
+		cap:     newControllerCapabilities(),
+	}
+}